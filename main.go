@@ -18,62 +18,32 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	etcdtypes "github.com/coreos/etcd/pkg/types"
-	"github.com/coreos/pkg/capnslog"
-	"github.com/urfave/cli"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/signal"
-	"sync"
-	"syscall"
-	"time"
+
+	etcdtypes "github.com/coreos/etcd/pkg/types"
+	"github.com/urfave/cli"
+
+	"github.com/joejulian/mgmt/pkg/etcd"
+	"github.com/joejulian/mgmt/pkg/functional"
+	gmain "github.com/joejulian/mgmt/pkg/main"
+	"github.com/joejulian/mgmt/pkg/snapshot"
 )
 
 // set at compile time
 var (
 	program string
 	version string
-	prefix  = fmt.Sprintf("/var/lib/%s/", program)
 )
 
-const (
-	DEBUG   = false // add additional log messages
-	TRACE   = false // add execution flow log messages
-	VERBOSE = false // add extra log message output
-)
-
-// signal handler
-func waitForSignal(exit chan bool) {
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt) // catch ^C
-	//signal.Notify(signals, os.Kill) // catch signals
-	signal.Notify(signals, syscall.SIGTERM)
-
-	select {
-	case e := <-signals: // any signal will do
-		if e == os.Interrupt {
-			log.Println("Interrupted by ^C")
-		} else {
-			log.Println("Interrupted by signal")
-		}
-	case <-exit: // or a manual signal
-		log.Println("Interrupted by exit signal")
-	}
-}
-
-// run is the main run target.
+// run is the thin `urfave/cli` adapter: it validates and translates the CLI
+// flags into a gmain.Main, and hands off to Main.Run() to do the real work.
+// Everything that used to happen in here now lives in pkg/main so that other
+// Go programs can embed mgmt directly instead of forking this binary.
 func run(c *cli.Context) error {
-	var start = time.Now().UnixNano()
-	log.Printf("This is: %v, version: %v", program, version)
-	log.Printf("Main: Start: %v", start)
-
 	hostname := c.String("hostname")
-	if hostname == "" {
-		hostname, _ = os.Hostname()
-	}
-	noop := c.Bool("noop")
 
 	seeds, err := etcdtypes.NewURLs(
 		FlattenListWithSplit(c.StringSlice("seeds"), []string{",", ";", " "}),
@@ -97,281 +67,203 @@ func run(c *cli.Context) error {
 		return cli.NewExitError("", 1)
 	}
 
-	idealClusterSize := uint16(c.Int("ideal-cluster-size"))
-	if idealClusterSize < 1 {
-		log.Printf("Main: Error: idealClusterSize should be at least one!")
-		return cli.NewExitError("", 1)
-	}
-
-	if c.IsSet("file") && c.IsSet("puppet") {
-		log.Println("Main: Error: the --file and --puppet parameters cannot be used together!")
-		return cli.NewExitError("", 1)
-	}
-
-	if c.Bool("no-server") && len(c.StringSlice("remote")) > 0 {
-		// TODO: in this case, we won't be able to tunnel stuff back to
-		// here, so if we're okay with every remote graph running in an
-		// isolated mode, then this is okay. Improve on this if there's
-		// someone who really wants to be able to do this.
-		log.Println("Main: Error: the --no-server and --remote parameters cannot be used together!")
-		return cli.NewExitError("", 1)
-	}
-
 	cConns := uint16(c.Int("cconns"))
 	if cConns < 0 {
 		log.Printf("Main: Error: --cconns should be at least zero!")
 		return cli.NewExitError("", 1)
 	}
 
-	if c.IsSet("prefix") && c.Bool("tmp-prefix") {
-		log.Println("Main: Error: combining --prefix and the request for a tmp prefix is illogical!")
-		return cli.NewExitError("", 1)
+	obj := &gmain.Main{
+		Program: program,
+		Version: version,
+
+		Seeds:         seeds,
+		ClientURLs:    clientURLs,
+		ServerURLs:    serverURLs,
+		NoServer:      c.Bool("no-server"),
+		JoinAsLearner: c.Bool("join-as-learner"),
+
+		IdealClusterSize: uint16(c.Int("ideal-cluster-size")),
+		ConvergedTimeout: c.Int("converged-timeout"),
+		MaxRuntime:       uint(c.Int("max-runtime")),
+
+		Noop: c.Bool("noop"),
+
+		NoWatch:    c.Bool("no-watch"),
+		Puppet:     c.String("puppet"),
+		PuppetConf: c.String("puppet-conf"),
+
+		Remote:           c.StringSlice("remote"),
+		CConns:           cConns,
+		AllowInteractive: c.Bool("allow-interactive"),
+		SSHPrivIDRSA:     c.String("ssh-priv-id-rsa"),
+		NoCaching:        c.Bool("no-caching"),
+
+		GraphvizFilter: c.String("graphviz-filter"),
+		Graphviz:       c.String("graphviz"),
+
+		LogLevel:         c.GlobalString("log-level"),
+		LogPackageLevels: c.GlobalString("log-package-levels"),
+		LogOutput:        c.GlobalString("log-output"),
+		LogFormat:        c.GlobalString("log-format"),
+
+		SnapshotInterval: uint(c.Int("snapshot-interval")),
+		SnapshotFile:     c.String("snapshot-file"),
+	}
+	if hostname != "" {
+		obj.Hostname = &hostname
+	}
+	if c.IsSet("file") {
+		obj.File = c.String("file")
 	}
-	if s := c.String("prefix"); c.IsSet("prefix") && s != "" {
-		prefix = s
+	if c.IsSet("prefix") {
+		s := c.String("prefix")
+		obj.Prefix = &s
 	}
+	obj.TmpPrefix = c.Bool("tmp-prefix")
+	obj.AllowTmpPrefix = c.Bool("allow-tmp-prefix")
 
-	// make sure the working directory prefix exists
-	if c.Bool("tmp-prefix") || os.MkdirAll(prefix, 0770) != nil {
-		if c.Bool("tmp-prefix") || c.Bool("allow-tmp-prefix") {
-			if prefix, err = ioutil.TempDir("", program+"-"); err != nil {
-				log.Printf("Main: Error: Can't create temporary prefix!")
-				return cli.NewExitError("", 1)
-			}
-			log.Println("Main: Warning: Working prefix directory is temporary!")
-
-		} else {
-			log.Printf("Main: Error: Can't create prefix!")
-			return cli.NewExitError("", 1)
-		}
+	if err := obj.Init(); err != nil {
+		log.Printf("Main: Error: %v", err)
+		return cli.NewExitError("", 1)
 	}
-	log.Printf("Main: Working prefix is: %s", prefix)
-
-	var wg sync.WaitGroup
-	exit := make(chan bool) // exit signal
-	var G, fullGraph *Graph
-
-	// exit after `max-runtime` seconds for no reason at all...
-	if i := c.Int("max-runtime"); i > 0 {
-		go func() {
-			time.Sleep(time.Duration(i) * time.Second)
-			exit <- true
-		}()
+
+	return obj.Run()
+}
+
+// setupLogging configures logging from the top-level --log-* flags for the
+// subcommands that don't go through gmain.Main.Init() (which does this
+// itself for `mgmt run`).
+func setupLogging(c *cli.Context) error {
+	if err := gmain.SetupLogging(
+		c.GlobalString("log-level"),
+		c.GlobalString("log-package-levels"),
+		c.GlobalString("log-output"),
+		c.GlobalString("log-format"),
+	); err != nil {
+		return cli.NewExitError(fmt.Sprintf("logging: %v", err), 1)
 	}
+	return nil
+}
 
-	// setup converger
-	converger := NewConverger(
-		c.Int("converged-timeout"),
-		func(b bool) error { // lambda to run when converged
-			if b {
-				log.Printf("Converged for %d seconds, exiting!", c.Int("converged-timeout"))
-				exit <- true // trigger an exit!
-			}
-			return nil
-		},
-	)
-	go converger.Loop(true) // main loop for converger, true to start paused
+// nullGraphExporter satisfies snapshot.GraphExporter for the standalone
+// `mgmt snapshot save` CLI command, which runs outside of any live mgmt
+// process and so has no in-memory graph to export. Running `run` with
+// --snapshot-interval is what captures the live graph shape; this command
+// only captures the etcd-level state of a cluster from the outside.
+type nullGraphExporter struct{}
 
-	// embedded etcd
-	if len(seeds) == 0 {
-		log.Printf("Main: Seeds: No seeds specified!")
-	} else {
-		log.Printf("Main: Seeds(%v): %v", len(seeds), seeds)
+func (nullGraphExporter) ExportSnapshot() (*snapshot.GraphState, error) {
+	return &snapshot.GraphState{}, nil
+}
+
+// snapshotSave implements `mgmt snapshot save <file>`.
+func snapshotSave(c *cli.Context) error {
+	if err := setupLogging(c); err != nil {
+		return err
+	}
+	path := c.Args().First()
+	if path == "" {
+		return cli.NewExitError("snapshot save: a destination file is required", 1)
 	}
-	EmbdEtcd := NewEmbdEtcd(
-		hostname,
-		seeds,
-		clientURLs,
-		serverURLs,
-		c.Bool("no-server"),
-		idealClusterSize,
-		prefix,
-		converger,
+	seeds, err := etcdtypes.NewURLs(
+		FlattenListWithSplit(c.StringSlice("seeds"), []string{",", ";", " "}),
 	)
-	if EmbdEtcd == nil {
-		// TODO: verify EmbdEtcd is not nil below...
-		log.Printf("Main: Etcd: Creation failed!")
-		exit <- true
-	} else if err := EmbdEtcd.Startup(); err != nil { // startup (returns when etcd main loop is running)
-		log.Printf("Main: Etcd: Startup failed: %v", err)
-		exit <- true
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("snapshot save: seeds didn't parse correctly: %v", err), 1)
 	}
 
-	exitchan := make(chan Event) // exit event
-	go func() {
-		startchan := make(chan struct{}) // start signal
-		go func() { startchan <- struct{}{} }()
-		file := c.String("file")
-		var configchan chan bool
-		var puppetchan <-chan time.Time
-		if !c.Bool("no-watch") && c.IsSet("file") {
-			configchan = ConfigWatch(file)
-		} else if c.IsSet("puppet") {
-			interval := PuppetInterval(c.String("puppet-conf"))
-			puppetchan = time.Tick(time.Duration(interval) * time.Second)
-		}
-		log.Println("Etcd: Starting...")
-		etcdchan := EtcdWatch(EmbdEtcd)
-		first := true // first loop or not
-		for {
-			log.Println("Main: Waiting...")
-			select {
-			case <-startchan: // kick the loop once at start
-				// pass
-
-			case b := <-etcdchan:
-				if !b { // ignore the message
-					continue
-				}
-				// everything else passes through to cause a compile!
-
-			case <-puppetchan:
-				// nothing, just go on
-
-			case msg := <-configchan:
-				if c.Bool("no-watch") || !msg {
-					continue // not ready to read config
-				}
-			// XXX: case compile_event: ...
-			// ...
-			case msg := <-exitchan:
-				msg.ACK()
-				return
-			}
-
-			var config *GraphConfig
-			if c.IsSet("file") {
-				config = ParseConfigFromFile(file)
-			} else if c.IsSet("puppet") {
-				config = ParseConfigFromPuppet(c.String("puppet"), c.String("puppet-conf"))
-			}
-			if config == nil {
-				log.Printf("Config: Parse failure")
-				continue
-			}
-
-			// run graph vertex LOCK...
-			if !first { // TODO: we can flatten this check out I think
-				converger.Pause() // FIXME: add sync wait?
-				G.Pause()         // sync
-			}
-
-			// build graph from yaml file on events (eg: from etcd)
-			// we need the vertices to be paused to work on them
-			if newFullgraph, err := fullGraph.NewGraphFromConfig(config, EmbdEtcd, hostname, noop); err == nil { // keep references to all original elements
-				fullGraph = newFullgraph
-			} else {
-				log.Printf("Config: Error making new graph from config: %v", err)
-				// unpause!
-				if !first {
-					G.Start(&wg, first) // sync
-					converger.Start()   // after G.Start()
-				}
-				continue
-			}
-
-			G = fullGraph.Copy() // copy to active graph
-			// XXX: do etcd transaction out here...
-			G.AutoEdges() // add autoedges; modifies the graph
-			G.AutoGroup() // run autogroup; modifies the graph
-			// TODO: do we want to do a transitive reduction?
-
-			log.Printf("Graph: %v", G) // show graph
-			err := G.ExecGraphviz(c.String("graphviz-filter"), c.String("graphviz"))
-			if err != nil {
-				log.Printf("Graphviz: %v", err)
-			} else {
-				log.Printf("Graphviz: Successfully generated graph!")
-			}
-			G.AssociateData(converger)
-			// G.Start(...) needs to be synchronous or wait,
-			// because if half of the nodes are started and
-			// some are not ready yet and the EtcdWatch
-			// loops, we'll cause G.Pause(...) before we
-			// even got going, thus causing nil pointer errors
-			G.Start(&wg, first) // sync
-			converger.Start()   // after G.Start()
-			first = false
-		}
-	}()
-
-	configWatcher := NewConfigWatcher()
-	events := configWatcher.Events()
-	if !c.Bool("no-watch") {
-		configWatcher.Add(c.StringSlice("remote")...) // add all the files...
-	} else {
-		events = nil // signal that no-watch is true
+	// the seeds double as the client URLs that snapshot.Save reads from
+	e := etcd.NewEmbdEtcd(context.Background(), "", seeds, seeds, nil, true, defaultIdealClusterSize, "")
+	if err := e.Startup(); err != nil {
+		return cli.NewExitError(fmt.Sprintf("snapshot save: can't connect: %v", err), 1)
 	}
+	defer e.Destroy()
 
-	// build remotes struct for remote ssh
-	remotes := NewRemotes(
-		EmbdEtcd.LocalhostClientURLs().StringSlice(),
-		[]string{DefaultClientURL},
-		noop,
-		c.StringSlice("remote"), // list of files
-		events,                  // watch for file changes
-		cConns,
-		c.Bool("allow-interactive"),
-		c.String("ssh-priv-id-rsa"),
-		!c.Bool("no-caching"),
-		prefix,
-	)
-
-	// TODO: is there any benefit to running the remotes above in the loop?
-	// wait for etcd to be running before we remote in, which we do above!
-	go remotes.Run()
-
-	if !c.IsSet("file") && !c.IsSet("puppet") {
-		converger.Start() // better start this for empty graphs
+	f, err := os.Create(path)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("snapshot save: %v", err), 1)
 	}
-	log.Println("Main: Running...")
+	defer f.Close()
 
-	waitForSignal(exit) // pass in exit channel to watch
-
-	log.Println("Destroy...")
+	if err := snapshot.Save(context.Background(), e, nullGraphExporter{}, f); err != nil {
+		return cli.NewExitError(fmt.Sprintf("snapshot save: %v", err), 1)
+	}
+	return nil
+}
 
-	configWatcher.Close() // stop sending file changes to remotes
-	remotes.Exit()        // tell all the remote connections to shutdown; waits!
+// snapshotRestore implements `mgmt snapshot restore <file>`.
+func snapshotRestore(c *cli.Context) error {
+	if err := setupLogging(c); err != nil {
+		return err
+	}
+	path := c.Args().First()
+	if path == "" {
+		return cli.NewExitError("snapshot restore: a source file is required", 1)
+	}
+	prefix := c.String("prefix")
+	if prefix == "" {
+		return cli.NewExitError("snapshot restore: --prefix is required", 1)
+	}
 
-	G.Exit() // tell all the children to exit
+	f, err := os.Open(path)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("snapshot restore: %v", err), 1)
+	}
+	defer f.Close()
 
-	// tell inner main loop to exit
-	resp := NewResp()
-	go func() { exitchan <- Event{eventExit, resp, "", false} }()
+	graphState, err := snapshot.Restore(context.Background(), f, prefix)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("snapshot restore: %v", err), 1)
+	}
+	log.Printf("snapshot restore: restored %d vertices, %d edges into %s", len(graphState.Vertices), len(graphState.Edges), prefix)
+	return nil
+}
 
-	// cleanup etcd main loop last so it can process everything first
-	if err := EmbdEtcd.Destroy(); err != nil { // shutdown and cleanup etcd
-		log.Printf("Etcd exited poorly with: %v", err)
+// runFunctional implements `mgmt functional <plan.yaml>`.
+func runFunctional(c *cli.Context) error {
+	if err := setupLogging(c); err != nil {
+		return err
+	}
+	path := c.Args().First()
+	if path == "" {
+		return cli.NewExitError("functional: a test plan file is required", 1)
 	}
 
-	resp.ACKWait() // let inner main loop finish cleanly just in case
+	plan, err := functional.LoadPlan(path)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
 
-	if DEBUG {
-		log.Printf("Graph: %v", G)
+	harness := functional.NewHarness(plan)
+	report, err := harness.Run()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
 	}
 
-	wg.Wait() // wait for primary go routines to exit
+	out := os.Stdout
+	if o := c.String("output"); o != "" {
+		f, err := os.Create(o)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := report.WriteJUnit(out); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
 
-	// TODO: wait for each vertex to exit...
-	log.Println("Goodbye!")
+	if !report.OK() {
+		return cli.NewExitError(fmt.Sprintf("functional: %d of %d assertions failed", report.Failures, report.Tests), 1)
+	}
 	return nil
 }
 
 func main() {
-	var flags int
-	if DEBUG || true { // TODO: remove || true
-		flags = log.LstdFlags | log.Lshortfile
-	}
-	flags = (flags - log.Ldate) // remove the date for now
-	log.SetFlags(flags)
-
-	// un-hijack from capnslog...
-	log.SetOutput(os.Stderr)
-	if VERBOSE {
-		capnslog.SetFormatter(capnslog.NewLogFormatter(os.Stderr, "(etcd) ", flags))
-	} else {
-		capnslog.SetFormatter(capnslog.NewNilFormatter())
-	}
+	// a minimal bootstrap logger for the few messages logged before
+	// gmain.SetupLogging runs from the parsed --log-* flags
+	log.SetFlags(log.LstdFlags | log.Lshortfile - log.Ldate)
 
 	// test for sanity
 	if program == "" || version == "" {
@@ -383,6 +275,33 @@ func main() {
 	app.Version = version
 	//app.Action = ... // without a default action, help runs
 
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "log-level",
+			Value:  "INFO",
+			Usage:  "CRITICAL, ERROR, WARNING, NOTICE, INFO, DEBUG or TRACE",
+			EnvVar: "MGMT_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-package-levels",
+			Value:  "",
+			Usage:  "per-package log levels, eg: main=INFO,etcd=DEBUG,resources.file=TRACE",
+			EnvVar: "MGMT_LOG_PACKAGE_LEVELS",
+		},
+		cli.StringFlag{
+			Name:   "log-output",
+			Value:  "stderr",
+			Usage:  "stdout, stderr or file:/path/to/file",
+			EnvVar: "MGMT_LOG_OUTPUT",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  "pretty",
+			Usage:  "pretty, json or glog",
+			EnvVar: "MGMT_LOG_FORMAT",
+		},
+	}
+
 	app.Commands = []cli.Command{
 		{
 			Name:    "run",
@@ -446,6 +365,10 @@ func main() {
 					Name:  "no-server",
 					Usage: "do not let other servers peer with me",
 				},
+				cli.BoolFlag{
+					Name:  "join-as-learner",
+					Usage: "request a non-voting learner join (the etcd client in use has no learner support, so this logs a warning and joins as a voting member)",
+				},
 				cli.IntFlag{
 					Name:   "ideal-cluster-size",
 					Value:  defaultIdealClusterSize,
@@ -516,6 +439,63 @@ func main() {
 					Name:  "allow-tmp-prefix",
 					Usage: "allow creation of a new temporary prefix if main prefix is unavailable",
 				},
+				cli.IntFlag{
+					Name:   "snapshot-interval",
+					Value:  0,
+					Usage:  "auto-snapshot the etcd state and graph this often (seconds), 0 to disable",
+					EnvVar: "MGMT_SNAPSHOT_INTERVAL",
+				},
+				cli.StringFlag{
+					Name:  "snapshot-file",
+					Value: "",
+					Usage: "path to write auto-snapshots to, defaults to prefix/snapshot.tar",
+				},
+			},
+		},
+		{
+			Name:  "snapshot",
+			Usage: "save or restore an etcd + graph snapshot",
+			Subcommands: []cli.Command{
+				{
+					Name:      "save",
+					Usage:     "save a snapshot of the running cluster to a file",
+					Action:    snapshotSave,
+					ArgsUsage: "<file>",
+					Flags: []cli.Flag{
+						cli.StringSliceFlag{
+							Name:   "seeds, s",
+							Value:  &cli.StringSlice{},
+							Usage:  "default etc client endpoint",
+							EnvVar: "MGMT_SEEDS",
+						},
+					},
+				},
+				{
+					Name:      "restore",
+					Usage:     "restore an etcd + graph snapshot into a fresh prefix",
+					Action:    snapshotRestore,
+					ArgsUsage: "<file>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "prefix",
+							Usage:  "path to the working prefix directory to restore into",
+							EnvVar: "MGMT_PREFIX",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:      "functional",
+			Usage:     "run a multi-node functional test plan with fault injection",
+			Action:    runFunctional,
+			ArgsUsage: "<plan.yaml>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "",
+					Usage: "write a JUnit XML report here instead of stdout",
+				},
 			},
 		},
 	}
@@ -0,0 +1,192 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package etcd wraps an embedded etcd server and client together so that a
+// cluster of mgmt hosts can share graph state without depending on an
+// externally run etcd. This file only covers cluster membership; watching
+// and the key/value store live elsewhere.
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	etcdtypes "github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/pkg/capnslog"
+)
+
+var log = capnslog.NewPackageLogger("github.com/joejulian/mgmt", "etcd")
+
+// EmbdEtcd wraps an embedded etcd server (when we're a peer) and the client
+// connection to the cluster (which we always have, peer or not).
+type EmbdEtcd struct {
+	ctx context.Context
+
+	hostname   string
+	seeds      []etcdtypes.URL
+	clientURLs []etcdtypes.URL
+	serverURLs []etcdtypes.URL
+	noServer   bool
+
+	// idealClusterSize would drive a learner-first auto-scaling policy
+	// (grow via a learner, promote once caught up) once that's possible;
+	// see JoinAsLearner's doc comment for why it currently isn't.
+	idealClusterSize uint16
+	prefix           string
+
+	// JoinAsLearner asks Startup() to add this member to an existing
+	// cluster as a non-voting learner instead of a full voting member,
+	// to avoid the quorum-loss risk of adding a slow member directly as
+	// a voter. This needs etcd 3.4+'s MemberAddAsLearner/MemberPromote,
+	// which don't exist on github.com/coreos/etcd/clientv3 (the import
+	// this repo uses tops out at 3.3.x); until this repo depends on
+	// go.etcd.io/etcd instead, join() logs a warning and falls back to
+	// a regular voting join.
+	JoinAsLearner bool
+
+	ourMemberID uint64 // our own member id, set once join() succeeds
+
+	server *embed.Etcd
+	client *clientv3.Client
+
+	exit chan struct{}
+}
+
+// NewEmbdEtcd creates a new embedded etcd struct. It doesn't start anything
+// until Startup is called. ctx is passed to the member-add RPC that Startup
+// makes when joining, so cancelling it aborts that RPC; it does not shut
+// down the server or client, which is what Destroy does.
+func NewEmbdEtcd(ctx context.Context, hostname string, seeds, clientURLs, serverURLs []etcdtypes.URL, noServer bool, idealClusterSize uint16, prefix string) *EmbdEtcd {
+	obj := &EmbdEtcd{
+		ctx:              ctx,
+		hostname:         hostname,
+		seeds:            seeds,
+		clientURLs:       clientURLs,
+		serverURLs:       serverURLs,
+		noServer:         noServer,
+		idealClusterSize: idealClusterSize,
+		prefix:           prefix,
+		exit:             make(chan struct{}),
+	}
+	return obj
+}
+
+// Startup brings up the embedded etcd server (if we're not --no-server) and
+// connects a client to the cluster. It returns once the etcd main loop is
+// running.
+func (obj *EmbdEtcd) Startup() error {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: obj.seedStrings(),
+	})
+	if err != nil {
+		return fmt.Errorf("etcd: can't connect client: %v", err)
+	}
+	obj.client = client
+
+	if obj.noServer {
+		return nil
+	}
+
+	if len(obj.seeds) > 0 { // joining an existing cluster
+		if err := obj.join(); err != nil {
+			return err
+		}
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Name = obj.hostname
+	cfg.Dir = obj.prefix
+	if len(obj.clientURLs) > 0 { // don't clobber embed's listen defaults
+		cfg.LCUrls = toURLs(obj.clientURLs)
+	}
+	if len(obj.serverURLs) > 0 {
+		cfg.LPUrls = toURLs(obj.serverURLs)
+	}
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		return fmt.Errorf("etcd: can't start embedded server: %v", err)
+	}
+	obj.server = server
+
+	return nil
+}
+
+// join adds obj to an existing cluster via one of the seeds. It records the
+// member id etcd assigned us. JoinAsLearner is currently best-effort: see
+// its doc comment for why it falls back to a regular voting join.
+func (obj *EmbdEtcd) join() error {
+	peerURLs := stringURLs(obj.serverURLs)
+	if obj.JoinAsLearner {
+		log.Warningf("%s: learner joins need etcd 3.4+'s client; joining as a voting member instead", obj.hostname)
+	}
+	log.Infof("adding %s as a voting member", obj.hostname)
+	resp, err := obj.client.MemberAdd(obj.ctx, peerURLs)
+	if err != nil {
+		return err
+	}
+	obj.ourMemberID = resp.Member.ID
+	return nil
+}
+
+// Destroy shuts down the embedded server and client connection cleanly.
+func (obj *EmbdEtcd) Destroy() error {
+	close(obj.exit)
+	if obj.server != nil {
+		obj.server.Close()
+	}
+	if obj.client != nil {
+		return obj.client.Close()
+	}
+	return nil
+}
+
+// LocalhostClientURLs returns the client URLs reachable from this host.
+func (obj *EmbdEtcd) LocalhostClientURLs() etcdtypes.URLs {
+	return etcdtypes.URLs(obj.clientURLs)
+}
+
+func (obj *EmbdEtcd) seedStrings() []string { return stringURLs(obj.seeds) }
+func (obj *EmbdEtcd) clientURLString() string {
+	if len(obj.clientURLs) == 0 {
+		return ""
+	}
+	return obj.clientURLs[0].String()
+}
+
+// MemberID returns the member id etcd assigned us when we joined an
+// existing cluster via Startup(), or 0 if we formed the initial cluster.
+func (obj *EmbdEtcd) MemberID() uint64 { return obj.ourMemberID }
+
+func stringURLs(urls []etcdtypes.URL) []string {
+	out := make([]string, len(urls))
+	for i, u := range urls {
+		out[i] = u.String()
+	}
+	return out
+}
+
+func toURLs(urls []etcdtypes.URL) []url.URL {
+	out := make([]url.URL, len(urls))
+	for i, u := range urls {
+		out[i] = url.URL(u)
+	}
+	return out
+}
@@ -0,0 +1,104 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package functional
+
+import (
+	"fmt"
+	"time"
+)
+
+// assertLiveness checks that every member which wasn't killed by a
+// kill-member fault is still running at the end of the plan's deadline.
+func (obj *Harness) assertLiveness(report *Report) {
+	start := time.Now()
+	var err error
+	for name, m := range obj.members {
+		m.doneMu.Lock()
+		done := m.done
+		m.doneMu.Unlock()
+		if done && !obj.killed(name) {
+			err = fmt.Errorf("member %s exited unexpectedly", name)
+			break
+		}
+	}
+	report.Add("liveness", time.Since(start).Seconds(), err)
+}
+
+// assertSafety checks that every surviving member reaches a converged
+// state once its faults have healed, using gmain.Main.Converged().
+func (obj *Harness) assertSafety(report *Report) {
+	start := time.Now()
+	var err error
+	for name, m := range obj.members {
+		if obj.killed(name) {
+			continue
+		}
+		m.doneMu.Lock()
+		done := m.done
+		m.doneMu.Unlock()
+		if done {
+			err = fmt.Errorf("member %s did not survive to check for convergence", name)
+			break
+		}
+		if !m.Main.Converged() {
+			err = fmt.Errorf("member %s never reached a converged state", name)
+			break
+		}
+	}
+	report.Add("safety", time.Since(start).Seconds(), err)
+}
+
+// assertConsistency checks that every surviving member's view of the graph
+// agrees, by comparing each member's GraphHash().
+func (obj *Harness) assertConsistency(report *Report) {
+	start := time.Now()
+	var err error
+	var want string
+	var first string
+	for name, m := range obj.members {
+		if obj.killed(name) {
+			continue
+		}
+		hash, herr := m.Main.GraphHash()
+		if herr != nil {
+			err = fmt.Errorf("member %s: %v", name, herr)
+			break
+		}
+		if want == "" {
+			want, first = hash, name
+			continue
+		}
+		if hash != want {
+			err = fmt.Errorf("member %s's graph (%s) disagrees with member %s's (%s)", name, hash, first, want)
+			break
+		}
+	}
+	report.Add("consistency", time.Since(start).Seconds(), err)
+}
+
+// killed reports whether name was the target of a kill-member fault in the
+// plan, so assertLiveness/assertSafety don't flag an intentional kill as a
+// failure.
+func (obj *Harness) killed(name string) bool {
+	for _, f := range obj.Plan.Faults {
+		if f.Type == "kill-member" && f.Target == name {
+			return true
+		}
+	}
+	return false
+}
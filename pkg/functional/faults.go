@@ -0,0 +1,135 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package functional
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (obj *Harness) faultBlackholePeer(f Fault) error {
+	m, ok := obj.members[f.Target]
+	if !ok {
+		return fmt.Errorf("unknown instance %q", f.Target)
+	}
+	if m.Proxy == nil {
+		return fmt.Errorf("instance %q has no proxy to blackhole", f.Target)
+	}
+	m.Proxy.Blackhole()
+	return nil
+}
+
+// faultPartition blackholes every member named in Args["members"] (a comma
+// separated list), isolating them from the rest of the cluster.
+func (obj *Harness) faultPartition(f Fault) error {
+	return obj.forEachPartitionMember(f, obj.faultBlackholePeer)
+}
+
+func (obj *Harness) faultDelayPeer(f Fault) error {
+	m, ok := obj.members[f.Target]
+	if !ok {
+		return fmt.Errorf("unknown instance %q", f.Target)
+	}
+	if m.Proxy == nil {
+		return fmt.Errorf("instance %q has no proxy to delay", f.Target)
+	}
+	ms, err := strconv.Atoi(f.Args["ms"])
+	if err != nil {
+		return fmt.Errorf("delay-peer: invalid ms %q: %v", f.Args["ms"], err)
+	}
+	jitter, _ := strconv.Atoi(f.Args["jitter"]) // optional, defaults to 0
+	m.Proxy.DelayPeer(time.Duration(ms)*time.Millisecond, time.Duration(jitter)*time.Millisecond)
+	return nil
+}
+
+func (obj *Harness) faultDropPercent(f Fault) error {
+	m, ok := obj.members[f.Target]
+	if !ok {
+		return fmt.Errorf("unknown instance %q", f.Target)
+	}
+	if m.Proxy == nil {
+		return fmt.Errorf("instance %q has no proxy to drop on", f.Target)
+	}
+	n, err := strconv.Atoi(f.Args["percent"])
+	if err != nil {
+		return fmt.Errorf("drop-percent: invalid percent %q: %v", f.Args["percent"], err)
+	}
+	m.Proxy.DropPercent(n)
+	return nil
+}
+
+// faultKillMember stops an instance by sending on its Exit channel, which
+// runs the same orderly shutdown as any other exit request.
+func (obj *Harness) faultKillMember(f Fault) error {
+	m, ok := obj.members[f.Target]
+	if !ok {
+		return fmt.Errorf("unknown instance %q", f.Target)
+	}
+	go m.stop(fmt.Errorf("functional: kill-member fault"))
+	return nil
+}
+
+// faultCorruptFileResource overwrites Args["path"] with garbage bytes, to
+// see whether the file resource notices the drift and re-converges it.
+func (obj *Harness) faultCorruptFileResource(f Fault) error {
+	path := f.Args["path"]
+	if path == "" {
+		return fmt.Errorf("corrupt-file-resource: missing args.path")
+	}
+	return ioutil.WriteFile(path, []byte("corrupted-by-functional-tester\n"), 0640)
+}
+
+// healProxy undoes a blackhole-peer, delay-peer or drop-percent fault by
+// restoring f.Target's proxy to transparent forwarding.
+func (obj *Harness) healProxy(f Fault) error {
+	m, ok := obj.members[f.Target]
+	if !ok {
+		return fmt.Errorf("unknown instance %q", f.Target)
+	}
+	if m.Proxy == nil {
+		return fmt.Errorf("instance %q has no proxy to heal", f.Target)
+	}
+	m.Proxy.Heal()
+	return nil
+}
+
+// healPartition undoes a partition fault by healing every member named in
+// Args["members"].
+func (obj *Harness) healPartition(f Fault) error {
+	return obj.forEachPartitionMember(f, obj.healProxy)
+}
+
+// forEachPartitionMember runs fn against a Fault targeting each member
+// named in f.Args["members"] (a comma separated list), the shared member
+// list faultPartition and healPartition both act on.
+func (obj *Harness) forEachPartitionMember(f Fault, fn func(Fault) error) error {
+	names := strings.Split(f.Args["members"], ",")
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if err := fn(Fault{Target: name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package functional is a built-in functional-tester harness: it launches N
+// embedded mgmt instances, drives them through a scripted sequence of graph
+// changes, and injects faults against the etcd transport and resource
+// layer, the same kind of coverage the etcd project's functional tester
+// gave it. It's meant to be reusable both as a CI gate and as a local
+// reproducer for a user-filed bug.
+package functional
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	etcdtypes "github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/pkg/capnslog"
+
+	gmain "github.com/joejulian/mgmt/pkg/main"
+)
+
+var log = capnslog.NewPackageLogger("github.com/joejulian/mgmt", "functional")
+
+// faultHandlers maps a Fault.Type to the function that applies it.
+var faultHandlers = map[string]func(*Harness, Fault) error{
+	"blackhole-peer":        (*Harness).faultBlackholePeer,
+	"partition":             (*Harness).faultPartition,
+	"delay-peer":            (*Harness).faultDelayPeer,
+	"drop-percent":          (*Harness).faultDropPercent,
+	"kill-member":           (*Harness).faultKillMember,
+	"corrupt-file-resource": (*Harness).faultCorruptFileResource,
+}
+
+// healHandlers maps a Fault.Type to the function that undoes it, for the
+// fault types that support Fault.Heal. kill-member and
+// corrupt-file-resource aren't here: killing a member isn't reversible, and
+// a corrupted file is expected to self-heal through normal convergence
+// rather than through the fault being "undone".
+var healHandlers = map[string]func(*Harness, Fault) error{
+	"blackhole-peer": (*Harness).healProxy,
+	"partition":      (*Harness).healPartition,
+	"delay-peer":     (*Harness).healProxy,
+	"drop-percent":   (*Harness).healProxy,
+}
+
+// member is one running embedded mgmt instance under test.
+type member struct {
+	Config InstanceConfig
+	Main   *gmain.Main
+	Proxy  *Proxy
+
+	doneMu   sync.Mutex
+	done     bool // set once Run() has returned
+	stopOnce sync.Once
+}
+
+// stop asks this member to shut down, exactly once.
+func (obj *member) stop(cause error) {
+	obj.stopOnce.Do(func() {
+		obj.Main.Exit <- cause
+	})
+}
+
+// Harness runs a Plan: it owns the instances, their proxies, and the
+// resulting Report.
+type Harness struct {
+	Plan *Plan
+
+	members map[string]*member
+}
+
+// NewHarness builds a harness for plan. It doesn't start anything yet.
+func NewHarness(plan *Plan) *Harness {
+	return &Harness{
+		Plan:    plan,
+		members: make(map[string]*member),
+	}
+}
+
+// Run launches every instance in the plan, drives the scripted graph
+// changes and faults, waits for the plan's deadline, asserts liveness,
+// safety and consistency, and returns the resulting report. It does not
+// return an error for failed assertions -- those show up as failures in
+// the Report; Run only errors if the harness itself couldn't execute (eg:
+// a proxy failed to bind).
+func (obj *Harness) Run() (*Report, error) {
+	report := NewReport("mgmt-functional")
+
+	if err := obj.startMembers(); err != nil {
+		return nil, fmt.Errorf("functional: %v", err)
+	}
+	defer obj.stopMembers()
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, step := range obj.Plan.Script {
+		wg.Add(1)
+		go func(s Step) {
+			defer wg.Done()
+			time.Sleep(s.At)
+			if err := obj.applyStep(s); err != nil {
+				log.Warningf("script step on %s failed: %v", s.Instance, err)
+			}
+		}(step)
+	}
+	for _, f := range obj.Plan.Faults {
+		wg.Add(1)
+		go func(flt Fault) {
+			defer wg.Done()
+			time.Sleep(flt.At)
+			if err := obj.injectFault(flt); err != nil {
+				log.Warningf("fault %s on %s failed: %v", flt.Type, flt.Target, err)
+			}
+		}(f)
+	}
+	wg.Wait()
+
+	remaining := obj.Plan.Deadline - time.Since(start)
+	if remaining > 0 {
+		time.Sleep(remaining)
+	}
+
+	obj.assertLiveness(report)
+	obj.assertSafety(report)
+	obj.assertConsistency(report)
+
+	return report, nil
+}
+
+// startMembers creates and launches every instance in the plan. It runs in
+// two passes: first it allocates each instance's real etcd client/server
+// listeners and the Proxy that fronts its client endpoint, then it resolves
+// every instance's Seeds (peer names) to the proxy addresses of the members
+// they name, now that all of them exist, before finally starting each one.
+//
+// Peer faults (blackhole-peer, delay-peer, drop-percent, and partition,
+// which is built on blackhole-peer) act on this client-facing proxy.
+// EmbdEtcd doesn't support advertising a peer URL that differs from the one
+// it binds to, so the peer URLs a joining member registers are its real
+// server addresses and peer (Raft) traffic between members bypasses the
+// proxy; these faults only interrupt the client endpoint used to join and
+// to watch the cluster.
+func (obj *Harness) startMembers() error {
+	for _, cfg := range obj.Plan.Instances {
+		clientAddr, err := freeAddr()
+		if err != nil {
+			return fmt.Errorf("functional: %s: %v", cfg.Name, err)
+		}
+		proxyAddr, err := freeAddr()
+		if err != nil {
+			return fmt.Errorf("functional: %s: %v", cfg.Name, err)
+		}
+		serverAddr, err := freeAddr()
+		if err != nil {
+			return fmt.Errorf("functional: %s: %v", cfg.Name, err)
+		}
+
+		proxy, err := NewProxy(cfg.Name, proxyAddr, clientAddr)
+		if err != nil {
+			return fmt.Errorf("functional: %s: can't start proxy: %v", cfg.Name, err)
+		}
+
+		clientURLs, err := etcdtypes.NewURLs([]string{"http://" + clientAddr})
+		if err != nil {
+			return fmt.Errorf("functional: %s: %v", cfg.Name, err)
+		}
+		serverURLs, err := etcdtypes.NewURLs([]string{"http://" + serverAddr})
+		if err != nil {
+			return fmt.Errorf("functional: %s: %v", cfg.Name, err)
+		}
+
+		m := &member{Config: cfg, Proxy: proxy}
+		m.Main = &gmain.Main{
+			Program:    "mgmt-functional",
+			Version:    "functional-test",
+			File:       cfg.File,
+			ClientURLs: clientURLs,
+			ServerURLs: serverURLs,
+			Exit:       make(chan error),
+
+			IdealClusterSize: uint16(len(obj.Plan.Instances)), // Init rejects 0
+		}
+		if cfg.Prefix != "" {
+			prefix := cfg.Prefix
+			m.Main.Prefix = &prefix
+		} else {
+			m.Main.TmpPrefix = true
+			m.Main.AllowTmpPrefix = true
+		}
+
+		obj.members[cfg.Name] = m
+	}
+
+	for _, cfg := range obj.Plan.Instances {
+		if cfg.Seeds == "" {
+			continue
+		}
+		var addrs []string
+		for _, name := range strings.Split(cfg.Seeds, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			seed, ok := obj.members[name]
+			if !ok {
+				return fmt.Errorf("functional: %s: unknown seed %q", cfg.Name, name)
+			}
+			addrs = append(addrs, "http://"+seed.Proxy.Addr())
+		}
+		seeds, err := etcdtypes.NewURLs(addrs)
+		if err != nil {
+			return fmt.Errorf("functional: %s: %v", cfg.Name, err)
+		}
+		obj.members[cfg.Name].Main.Seeds = seeds
+	}
+
+	for _, m := range obj.members {
+		go func(mm *member) {
+			if err := mm.Main.Run(); err != nil {
+				log.Errorf("member %s exited with error: %v", mm.Config.Name, err)
+			}
+			mm.doneMu.Lock()
+			mm.done = true
+			mm.doneMu.Unlock()
+		}(m)
+	}
+	return nil
+}
+
+// freeAddr allocates a loopback TCP address that's currently unused, for
+// wiring up etcd listeners and proxies before anything is actually serving
+// on them.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+func (obj *Harness) stopMembers() {
+	for _, m := range obj.members {
+		m.doneMu.Lock()
+		done := m.done
+		m.doneMu.Unlock()
+		if done {
+			continue
+		}
+		go m.stop(fmt.Errorf("functional: test complete"))
+		if m.Proxy != nil {
+			m.Proxy.Close()
+		}
+	}
+}
+
+// applyStep copies a new graph definition file into place for an instance,
+// which ConfigWatch then picks up like any other live edit.
+func (obj *Harness) applyStep(s Step) error {
+	m, ok := obj.members[s.Instance]
+	if !ok {
+		return fmt.Errorf("unknown instance %q", s.Instance)
+	}
+	data, err := ioutil.ReadFile(s.File)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(m.Main.File, data, 0640)
+}
+
+// injectFault fires f, then, if f.Heal is set, blocks until that duration
+// elapses and undoes the fault before returning, so that the caller's
+// tracking of this call (Run's wg) covers the heal too -- otherwise Run
+// could reach its deadline and assert safety while a fault that was meant
+// to have healed by then is still in effect.
+func (obj *Harness) injectFault(f Fault) error {
+	handler, ok := faultHandlers[f.Type]
+	if !ok {
+		return fmt.Errorf("unknown fault type %q", f.Type)
+	}
+	if err := handler(obj, f); err != nil {
+		return err
+	}
+
+	if f.Heal <= 0 {
+		return nil
+	}
+	heal, ok := healHandlers[f.Type]
+	if !ok {
+		return nil
+	}
+	time.Sleep(f.Heal)
+	if err := heal(obj, f); err != nil {
+		return fmt.Errorf("heal: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package functional
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Plan is a YAML-defined test plan: how many embedded mgmt instances to
+// launch, what graph changes to drive them through, and what faults to
+// inject against the etcd transport and resource layer while that's
+// happening.
+type Plan struct {
+	Instances []InstanceConfig `yaml:"instances"`
+	Script    []Step           `yaml:"script"`
+	Faults    []Fault          `yaml:"faults"`
+	Deadline  time.Duration    `yaml:"deadline"` // overall liveness deadline
+}
+
+// InstanceConfig describes one embedded mgmt instance in the test cluster.
+type InstanceConfig struct {
+	Name   string `yaml:"name"`
+	Seeds  string `yaml:"seeds,omitempty"` // comma separated peer names to join
+	Prefix string `yaml:"prefix,omitempty"`
+	File   string `yaml:"file"` // initial graph definition file to run and watch
+}
+
+// Step is a scripted graph change: apply File on Instance after At elapses.
+type Step struct {
+	At       time.Duration `yaml:"at"`
+	Instance string        `yaml:"instance"`
+	File     string        `yaml:"file"`
+}
+
+// Fault is a single fault-injection event, fired At some point in the run.
+// Type is one of: blackhole-peer, delay-peer, drop-percent, kill-member,
+// corrupt-file-resource, partition. If Heal is set, the fault is undone
+// that long after it fires, so assertSafety has a chance to see the
+// affected members converge again; kill-member and corrupt-file-resource
+// ignore Heal since killing a member isn't reversible and a corrupted file
+// is expected to self-heal through normal convergence instead.
+type Fault struct {
+	At     time.Duration     `yaml:"at"`
+	Type   string            `yaml:"type"`
+	Target string            `yaml:"target"` // instance or member name the fault applies to
+	Heal   time.Duration     `yaml:"heal,omitempty"`
+	Args   map[string]string `yaml:"args,omitempty"`
+}
+
+// LoadPlan reads and validates a YAML test plan from disk.
+func LoadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("functional: can't read plan: %v", err)
+	}
+	var plan Plan
+	if err := yaml.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("functional: can't parse plan: %v", err)
+	}
+	if len(plan.Instances) == 0 {
+		return nil, fmt.Errorf("functional: plan must define at least one instance")
+	}
+	if plan.Deadline == 0 {
+		plan.Deadline = 2 * time.Minute
+	}
+	for _, f := range plan.Faults {
+		if _, ok := faultHandlers[f.Type]; !ok {
+			return nil, fmt.Errorf("functional: unknown fault type %q", f.Type)
+		}
+	}
+	return &plan, nil
+}
@@ -0,0 +1,181 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package functional
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Proxy sits in front of one EmbdEtcd instance's client or peer listener and
+// can be told to misbehave: drop connections, delay bytes, drop a
+// percentage of them, or stop forwarding entirely. It's the same idea as
+// etcd's own functional-tester proxy: the harness drives the proxy instead
+// of touching the real network, so the same fault-injection code works in
+// CI and as a local reproducer for a user-filed bug.
+type Proxy struct {
+	Name     string // the instance this proxy fronts
+	Upstream string // the real address we forward to
+
+	mu          sync.RWMutex
+	blackholed  bool
+	delay       time.Duration
+	jitter      time.Duration
+	dropPercent int
+
+	listener net.Listener
+	exit     chan struct{}
+}
+
+// NewProxy creates a proxy that listens on listenAddr and forwards
+// unmolested connections to upstream, until told otherwise.
+func NewProxy(name, listenAddr, upstream string) (*Proxy, error) {
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		Name:     name,
+		Upstream: upstream,
+		listener: l,
+		exit:     make(chan struct{}),
+	}
+	go p.serve()
+	return p, nil
+}
+
+// Addr is the address other instances should dial instead of Upstream.
+func (obj *Proxy) Addr() string { return obj.listener.Addr().String() }
+
+func (obj *Proxy) serve() {
+	for {
+		conn, err := obj.listener.Accept()
+		if err != nil {
+			select {
+			case <-obj.exit:
+				return
+			default:
+				continue
+			}
+		}
+		go obj.handle(conn)
+	}
+}
+
+func (obj *Proxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	obj.mu.RLock()
+	blackholed := obj.blackholed
+	obj.mu.RUnlock()
+	if blackholed {
+		return // drop the connection on the floor
+	}
+
+	upstream, err := net.Dial("tcp", obj.Upstream)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); obj.pipe(upstream, conn) }()
+	go func() { defer wg.Done(); obj.pipe(conn, upstream) }()
+	wg.Wait()
+}
+
+// pipe copies src to dst, applying the current delay/jitter/drop-percent
+// settings to each chunk it forwards.
+func (obj *Proxy) pipe(dst io.Writer, src io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			obj.mu.RLock()
+			blackholed := obj.blackholed
+			delay, jitter, dropPercent := obj.delay, obj.jitter, obj.dropPercent
+			obj.mu.RUnlock()
+
+			if blackholed {
+				return
+			}
+			if dropPercent > 0 && rand.Intn(100) < dropPercent {
+				continue // simulate packet loss by just not forwarding this chunk
+			}
+			if delay > 0 {
+				d := delay
+				if jitter > 0 {
+					d += time.Duration(rand.Int63n(int64(jitter)))
+				}
+				time.Sleep(d)
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Blackhole drops every byte in both directions until Heal is called. This
+// implements the "blackhole-peer" and "partition" faults.
+func (obj *Proxy) Blackhole() {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.blackholed = true
+}
+
+// Heal undoes Blackhole, DelayPeer and DropPercent, returning the proxy to
+// transparent forwarding.
+func (obj *Proxy) Heal() {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.blackholed = false
+	obj.delay = 0
+	obj.jitter = 0
+	obj.dropPercent = 0
+}
+
+// DelayPeer adds delay, plus a random extra of less than jitter, to every
+// chunk forwarded through the proxy. This implements the "delay-peer" fault.
+func (obj *Proxy) DelayPeer(delay, jitter time.Duration) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.delay = delay
+	obj.jitter = jitter
+}
+
+// DropPercent silently drops roughly n percent of forwarded chunks. This
+// implements the "drop-percent" fault.
+func (obj *Proxy) DropPercent(n int) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.dropPercent = n
+}
+
+// Close stops the proxy and releases its listener.
+func (obj *Proxy) Close() error {
+	close(obj.exit)
+	return obj.listener.Close()
+}
@@ -0,0 +1,77 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package functional
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// Report is a JUnit-style test report, so the functional harness can be
+// wired into any CI system that already understands JUnit XML.
+type Report struct {
+	XMLName  xml.Name   `xml:"testsuite"`
+	Name     string     `xml:"name,attr"`
+	Tests    int        `xml:"tests,attr"`
+	Failures int        `xml:"failures,attr"`
+	Cases    []TestCase `xml:"testcase"`
+}
+
+// TestCase is one assertion the harness made (liveness, safety, or
+// consistency) and its outcome.
+type TestCase struct {
+	Name    string   `xml:"name,attr"`
+	Seconds float64  `xml:"time,attr"`
+	Failure *Failure `xml:"failure,omitempty"`
+}
+
+// Failure is the JUnit failure element, present only on a failed TestCase.
+type Failure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// NewReport builds an (initially empty) report for a named functional run.
+func NewReport(name string) *Report {
+	return &Report{Name: name}
+}
+
+// Add records the outcome of one assertion. A nil err means the assertion
+// passed.
+func (obj *Report) Add(name string, seconds float64, err error) {
+	tc := TestCase{Name: name, Seconds: seconds}
+	if err != nil {
+		tc.Failure = &Failure{Message: err.Error(), Text: err.Error()}
+		obj.Failures++
+	}
+	obj.Tests++
+	obj.Cases = append(obj.Cases, tc)
+}
+
+// OK reports whether every assertion in the report passed.
+func (obj *Report) OK() bool { return obj.Failures == 0 }
+
+// WriteJUnit writes the report as JUnit XML.
+func (obj *Report) WriteJUnit(w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(obj)
+}
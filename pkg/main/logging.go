@@ -0,0 +1,152 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gmain
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+)
+
+// repo is the capnslog repository name that all of the mgmt packages log
+// under. It lets --log-package-levels address them as "etcd", "resources",
+// etc, the same way etcd's own --log-package-levels does.
+const repo = "github.com/joejulian/mgmt"
+
+// per-package loggers, one per major subsystem. These replace the old
+// `log.Printf`/`log.Println` call sites throughout mgmt; each file should
+// use the logger for the package it lives in instead of the global `log`
+// package, so that --log-package-levels can turn up (or down) the verbosity
+// of just that subsystem in production.
+var (
+	mainLog      = capnslog.NewPackageLogger(repo, "main")
+	etcdLog      = capnslog.NewPackageLogger(repo, "etcd")
+	remoteLog    = capnslog.NewPackageLogger(repo, "remote")
+	resourcesLog = capnslog.NewPackageLogger(repo, "resources")
+	convergerLog = capnslog.NewPackageLogger(repo, "converger")
+	graphLog     = capnslog.NewPackageLogger(repo, "graph")
+)
+
+// repoLogger is used to parse the --log-package-levels config and to set the
+// default level for every package logger in this repo at once. It must be
+// initialized after the NewPackageLogger calls above: capnslog registers a
+// package the first time NewPackageLogger is called for it, and
+// MustRepoLogger panics if no package has been registered under repo yet.
+// Go runs package-level initializers in declaration order, so this has to
+// come after the var block it depends on.
+var repoLogger = capnslog.MustRepoLogger(repo)
+
+// SetupLogging configures the per-package capnslog loggers from the
+// --log-level, --log-package-levels, --log-output and --log-format flags.
+// It replaces the old `DEBUG || true` hack that forced a single hardcoded
+// log.Logger configuration at startup.
+func SetupLogging(logLevel, logPackageLevels, logOutput, logFormat string) error {
+	level := capnslog.INFO
+	if logLevel != "" {
+		l, err := capnslog.ParseLevel(strings.ToUpper(logLevel))
+		if err != nil {
+			return fmt.Errorf("invalid --log-level %q: %v", logLevel, err)
+		}
+		level = l
+	}
+	repoLogger.SetLogLevel(map[string]capnslog.LogLevel{"*": level})
+
+	if logPackageLevels != "" {
+		m, err := repoLogger.ParseLogLevelConfig(logPackageLevels)
+		if err != nil {
+			return fmt.Errorf("invalid --log-package-levels %q: %v", logPackageLevels, err)
+		}
+		repoLogger.SetLogLevel(m)
+	}
+
+	w := os.Stderr
+	switch {
+	case logOutput == "" || logOutput == "stderr":
+		w = os.Stderr
+	case logOutput == "stdout":
+		w = os.Stdout
+	case strings.HasPrefix(logOutput, "file:"):
+		path := strings.TrimPrefix(logOutput, "file:")
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("can't open --log-output file %q: %v", path, err)
+		}
+		w = f
+	default:
+		return fmt.Errorf("invalid --log-output %q, expected stdout, stderr or file:/path", logOutput)
+	}
+
+	switch logFormat {
+	case "", "pretty":
+		capnslog.SetFormatter(capnslog.NewPrettyFormatter(w, false))
+	case "json":
+		capnslog.SetFormatter(newJSONFormatter(w))
+	case "glog":
+		capnslog.SetFormatter(capnslog.NewGlogFormatter(w))
+	default:
+		return fmt.Errorf("invalid --log-format %q, expected pretty, json or glog", logFormat)
+	}
+
+	return nil
+}
+
+// jsonFormatter writes one JSON object per log line. capnslog ships
+// pretty/glog formatters and a journald one, but nothing that writes plain
+// JSON to an arbitrary io.Writer, which is what --log-format=json promises.
+type jsonFormatter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// newJSONFormatter builds a capnslog.Formatter that writes newline-delimited
+// JSON to w.
+func newJSONFormatter(w io.Writer) capnslog.Formatter {
+	return &jsonFormatter{w: w}
+}
+
+// Format implements capnslog.Formatter.
+func (obj *jsonFormatter) Format(pkg string, level capnslog.LogLevel, depth int, entries ...interface{}) {
+	entry := struct {
+		Time    string `json:"time"`
+		Package string `json:"pkg"`
+		Level   string `json:"level"`
+		Msg     string `json:"msg"`
+	}{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Package: pkg,
+		Level:   level.String(),
+		Msg:     fmt.Sprint(entries...),
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.w.Write(append(b, '\n'))
+}
+
+// Flush implements capnslog.Formatter.
+func (obj *jsonFormatter) Flush() {}
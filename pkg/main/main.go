@@ -0,0 +1,530 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package gmain provides the embeddable entry point into mgmt. It exists so
+// that downstream Go programs can run mgmt as a library (their own graphs,
+// their own converge event subscriptions, programmatic shutdown) instead of
+// forking the `mgmt run` binary as a subprocess. The `mgmt` command itself is
+// just a thin `urfave/cli` adapter around the `Main` struct defined here.
+package gmain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	etcdtypes "github.com/coreos/etcd/pkg/types"
+
+	"github.com/joejulian/mgmt/pkg/etcd"
+	"github.com/joejulian/mgmt/pkg/snapshot"
+)
+
+// Main is the entry point for running mgmt. Build one of these, populate the
+// fields you care about, and call Run(). Program, Version and
+// IdealClusterSize must be set (Init rejects a zero value for any of them);
+// everything else is optional. Close or send on Exit to ask a running Main to
+// shut down; Run() returns once it has, with the error (if any) that caused it.
+type Main struct {
+	Program string // name of this program, eg: "mgmt"
+	Version string // version of this program
+
+	Hostname *string // hostname to use for the converger, nil to autodetect
+
+	Prefix         *string // path to the working prefix directory, nil for the default
+	TmpPrefix      bool    // request a pseudo-random, temporary prefix to be used
+	AllowTmpPrefix bool    // allow creation of a new temporary prefix if main prefix is unavailable
+
+	Seeds         []etcdtypes.URL // default etc client endpoints
+	ClientURLs    []etcdtypes.URL // list of URLs to listen on for client traffic
+	ServerURLs    []etcdtypes.URL // list of URLs to listen on for server (peer) traffic
+	NoServer      bool            // do not let other servers peer with me
+	JoinAsLearner bool            // request a non-voting learner join; EmbdEtcd logs a warning and joins as a voting member instead
+
+	IdealClusterSize uint16 // ideal number of server peers in cluster, only read by initial server
+	ConvergedTimeout int    // exit after approximately this many seconds in a converged state, -1 to disable
+	MaxRuntime       uint   // exit after a maximum of approximately this many seconds, 0 to disable
+
+	Noop bool // globally force all resources into no-op mode
+
+	File       string // graph definition file to run
+	NoWatch    bool   // do not update graph on watched graph definition file changes
+	Puppet     string // load graph from puppet, optionally takes a manifest or path to manifest file
+	PuppetConf string // path to an alternate puppet.conf file to use
+
+	Remote           []string // list of remote graph definitions to run
+	CConns           uint16   // number of maximum concurrent remote ssh connections to run, 0 for unlimited
+	AllowInteractive bool     // allow interactive prompting, such as for remote passwords
+	SSHPrivIDRSA     string   // default path to ssh key file, empty to never touch
+	NoCaching        bool     // don't allow remote caching of remote execution binary
+
+	GraphvizFilter string // graphviz filter to use
+	Graphviz       string // output file for graphviz data
+
+	LogLevel         string // CRITICAL|ERROR|WARNING|NOTICE|INFO|DEBUG|TRACE, default INFO
+	LogPackageLevels string // eg: "main=INFO,etcd=DEBUG,resources.file=TRACE"
+	LogOutput        string // stdout|stderr|file:/path, default stderr
+	LogFormat        string // pretty|json|glog, default pretty
+
+	SnapshotInterval uint   // auto-snapshot this often (seconds), 0 to disable
+	SnapshotFile     string // path to write auto-snapshots to, defaults to prefix/snapshot.tar
+
+	Exit chan error // send on (or close) to ask Run() to shut down early with this as the cause; never sent to by Run() itself
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	exitMu  sync.Mutex
+	exitErr error // the cause Run() returns, set before cancel
+
+	convergedMu sync.Mutex
+	converged   bool // last value the converger callback reported
+
+	graphMu      sync.Mutex
+	currentGraph *Graph // the active graph, as last assigned in the main loop
+}
+
+// Converged reports whether the converger last reported a converged state.
+// It's safe to call from another goroutine while Run() is in progress, eg:
+// by an embedder polling for convergence instead of using ConvergedTimeout.
+func (obj *Main) Converged() bool {
+	obj.convergedMu.Lock()
+	defer obj.convergedMu.Unlock()
+	return obj.converged
+}
+
+// GraphHash returns a hash of the currently active graph's exported shape
+// (vertices, edges, and each vertex's resource-state hash), so a caller
+// without direct access to the live *Graph -- eg: the functional test
+// harness comparing multiple members -- can cheaply check whether two
+// members converged on the same graph. It errors if the graph isn't ready
+// to export yet.
+func (obj *Main) GraphHash() (string, error) {
+	obj.graphMu.Lock()
+	g := obj.currentGraph
+	obj.graphMu.Unlock()
+
+	exporter, ok := interface{}(g).(snapshot.GraphExporter)
+	if g == nil || !ok {
+		return "", fmt.Errorf("main: graph isn't ready to export yet")
+	}
+	state, err := exporter.ExportSnapshot()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Init validates the Main struct and fills in any defaults that were left
+// unset. It must be called before Run().
+func (obj *Main) Init() error {
+	if obj.Program == "" || obj.Version == "" {
+		return fmt.Errorf("the Program and Version fields must be set")
+	}
+	if obj.IdealClusterSize < 1 {
+		return fmt.Errorf("IdealClusterSize should be at least one")
+	}
+	if obj.File != "" && obj.Puppet != "" {
+		return fmt.Errorf("the File and Puppet fields cannot be used together")
+	}
+	if obj.NoServer && len(obj.Remote) > 0 {
+		// TODO: in this case, we won't be able to tunnel stuff back to
+		// here, so if we're okay with every remote graph running in an
+		// isolated mode, then this is okay. Improve on this if there's
+		// someone who really wants to be able to do this.
+		return fmt.Errorf("the NoServer and Remote fields cannot be used together")
+	}
+	if obj.Prefix != nil && obj.TmpPrefix {
+		return fmt.Errorf("combining Prefix and TmpPrefix is illogical")
+	}
+
+	if err := SetupLogging(obj.LogLevel, obj.LogPackageLevels, obj.LogOutput, obj.LogFormat); err != nil {
+		return fmt.Errorf("logging: %v", err)
+	}
+
+	if obj.Exit == nil {
+		obj.Exit = make(chan error)
+	}
+	obj.ctx, obj.cancel = context.WithCancel(context.Background())
+
+	return nil
+}
+
+// shutdownTree listens for SIGINT/SIGTERM, an embedder asking us to stop via
+// Exit, or a local OS signal, and cancels the root context in response. It
+// also listens for SIGHUP and, rather than shutting anything down, tells the
+// caller to reload its config by sending on reload -- the equivalent of
+// today's config-file-changed event, but triggered on demand.
+func (obj *Main) shutdownTree(reload chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGHUP:
+				mainLog.Info("SIGHUP received, reloading config")
+				select {
+				case reload <- struct{}{}:
+				case <-obj.ctx.Done():
+				}
+				continue
+			case os.Interrupt:
+				mainLog.Info("Interrupted by ^C")
+			default:
+				mainLog.Info("Interrupted by signal")
+			}
+			obj.cancel()
+			return
+
+		case err := <-obj.Exit: // an embedder asking us to stop
+			if err != nil {
+				mainLog.Infof("Interrupted by error: %v", err)
+			} else {
+				mainLog.Info("Interrupted by exit request")
+			}
+			obj.exitMu.Lock()
+			obj.exitErr = err
+			obj.exitMu.Unlock()
+			obj.cancel()
+			return
+
+		case <-obj.ctx.Done(): // cancelled elsewhere (converged-timeout, max-runtime, ...)
+			return
+		}
+	}
+}
+
+// Run is the main mgmt run loop. It blocks until the node shuts down, either
+// because it was asked to (Exit), because of a local signal, or because of
+// the converged-timeout / max-runtime settings. It returns the error that
+// caused the shutdown, or nil for a clean exit.
+func (obj *Main) Run() error {
+	if obj.ctx == nil { // Init wasn't called
+		if err := obj.Init(); err != nil {
+			return err
+		}
+	}
+	ctx := obj.ctx
+
+	var start = time.Now().UnixNano()
+	mainLog.Infof("This is: %v, version: %v", obj.Program, obj.Version)
+	mainLog.Infof("Main: Start: %v", start)
+
+	hostname := ""
+	if obj.Hostname != nil {
+		hostname = *obj.Hostname
+	}
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	prefix := fmt.Sprintf("/var/lib/%s/", obj.Program)
+	if obj.Prefix != nil && *obj.Prefix != "" {
+		prefix = *obj.Prefix
+	}
+
+	// make sure the working directory prefix exists
+	if obj.TmpPrefix || os.MkdirAll(prefix, 0770) != nil {
+		if obj.TmpPrefix || obj.AllowTmpPrefix {
+			var err error
+			if prefix, err = ioutil.TempDir("", obj.Program+"-"); err != nil {
+				return fmt.Errorf("main: can't create temporary prefix: %v", err)
+			}
+			mainLog.Warning("Main: Working prefix directory is temporary!")
+
+		} else {
+			return fmt.Errorf("main: can't create prefix")
+		}
+	}
+	mainLog.Infof("Main: Working prefix is: %s", prefix)
+
+	var wg sync.WaitGroup
+	var G, fullGraph *Graph
+
+	// exit after `MaxRuntime` seconds for no reason at all...
+	if obj.MaxRuntime > 0 {
+		go func() {
+			select {
+			case <-time.After(time.Duration(obj.MaxRuntime) * time.Second):
+				obj.cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	// setup converger
+	converger := NewConverger(
+		ctx,
+		obj.ConvergedTimeout,
+		func(b bool) error { // lambda to run when converged
+			obj.convergedMu.Lock()
+			obj.converged = b
+			obj.convergedMu.Unlock()
+			if b {
+				mainLog.Infof("Converged for %d seconds, exiting!", obj.ConvergedTimeout)
+				obj.cancel() // trigger an exit!
+			}
+			return nil
+		},
+	)
+	go converger.Loop(true) // main loop for converger, true to start paused
+
+	// embedded etcd
+	if len(obj.Seeds) == 0 {
+		mainLog.Info("Main: Seeds: No seeds specified!")
+	} else {
+		mainLog.Infof("Main: Seeds(%v): %v", len(obj.Seeds), obj.Seeds)
+	}
+	EmbdEtcd := etcd.NewEmbdEtcd(
+		ctx,
+		hostname,
+		obj.Seeds,
+		obj.ClientURLs,
+		obj.ServerURLs,
+		obj.NoServer,
+		obj.IdealClusterSize,
+		prefix,
+	)
+	if EmbdEtcd == nil {
+		// TODO: verify EmbdEtcd is not nil below...
+		mainLog.Error("Main: Etcd: Creation failed!")
+		obj.cancel()
+	} else {
+		EmbdEtcd.JoinAsLearner = obj.JoinAsLearner
+		if err := EmbdEtcd.Startup(); err != nil { // startup (returns when etcd main loop is running)
+			mainLog.Errorf("Main: Etcd: Startup failed: %v", err)
+			obj.exitMu.Lock()
+			obj.exitErr = fmt.Errorf("main: etcd startup failed: %v", err)
+			obj.exitMu.Unlock()
+			obj.cancel()
+		}
+	}
+
+	// periodic auto-snapshot, so that a single surviving member can seed
+	// a fresh node (etcd state + graph shape) after a disastrous quorum
+	// loss, without needing the original config file or puppet source
+	if obj.SnapshotInterval > 0 {
+		snapshotFile := obj.SnapshotFile
+		if snapshotFile == "" {
+			snapshotFile = filepath.Join(prefix, "snapshot.tar")
+		}
+		go func() {
+			ticker := time.NewTicker(time.Duration(obj.SnapshotInterval) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+				exporter, ok := interface{}(G).(snapshot.GraphExporter)
+				if G == nil || !ok {
+					mainLog.Warning("Snapshot: graph isn't ready to export yet, skipping")
+					continue
+				}
+				f, err := os.Create(snapshotFile)
+				if err != nil {
+					mainLog.Errorf("Snapshot: %v", err)
+					continue
+				}
+				if err := snapshot.Save(ctx, EmbdEtcd, exporter, f); err != nil {
+					mainLog.Errorf("Snapshot: %v", err)
+				}
+				f.Close()
+			}
+		}()
+	}
+
+	reload := make(chan struct{}) // SIGHUP asks us to recompile on demand
+	go obj.shutdownTree(reload)
+
+	var innerWG sync.WaitGroup
+	innerWG.Add(1)
+	go func() {
+		defer innerWG.Done()
+		startchan := make(chan struct{}) // start signal
+		go func() { startchan <- struct{}{} }()
+		file := obj.File
+		var configchan chan bool
+		var puppetchan <-chan time.Time
+		if !obj.NoWatch && file != "" {
+			configchan = ConfigWatch(ctx, file)
+		} else if obj.Puppet != "" {
+			interval := PuppetInterval(ctx, obj.PuppetConf)
+			puppetchan = time.Tick(time.Duration(interval) * time.Second)
+		}
+		etcdLog.Info("Starting...")
+		etcdchan := EtcdWatch(ctx, EmbdEtcd)
+		first := true // first loop or not
+		for {
+			mainLog.Debug("Main: Waiting...")
+			select {
+			case <-startchan: // kick the loop once at start
+				// pass
+
+			case b := <-etcdchan:
+				if !b { // ignore the message
+					continue
+				}
+				// everything else passes through to cause a compile!
+
+			case <-puppetchan:
+				// nothing, just go on
+
+			case msg := <-configchan:
+				if obj.NoWatch || !msg {
+					continue // not ready to read config
+				}
+
+			case <-reload: // SIGHUP: recompile on demand, without tearing anything down
+				mainLog.Info("Main: Reloading on demand")
+
+			case <-ctx.Done():
+				return
+			}
+
+			var config *GraphConfig
+			if obj.File != "" {
+				config = ParseConfigFromFile(file)
+			} else if obj.Puppet != "" {
+				config = ParseConfigFromPuppet(obj.Puppet, obj.PuppetConf)
+			}
+			if config == nil {
+				mainLog.Error("Config: Parse failure")
+				continue
+			}
+
+			// run graph vertex LOCK...
+			if !first { // TODO: we can flatten this check out I think
+				converger.Pause() // FIXME: add sync wait?
+				G.Pause()         // sync
+			}
+
+			// build graph from yaml file on events (eg: from etcd)
+			// we need the vertices to be paused to work on them
+			if newFullgraph, err := fullGraph.NewGraphFromConfig(config, EmbdEtcd, hostname, obj.Noop); err == nil { // keep references to all original elements
+				fullGraph = newFullgraph
+			} else {
+				mainLog.Errorf("Config: Error making new graph from config: %v", err)
+				// unpause!
+				if !first {
+					G.Start(ctx, &wg, first) // sync
+					converger.Start()        // after G.Start()
+				}
+				continue
+			}
+
+			G = fullGraph.Copy() // copy to active graph
+			obj.graphMu.Lock()
+			obj.currentGraph = G
+			obj.graphMu.Unlock()
+			// XXX: do etcd transaction out here...
+			G.AutoEdges() // add autoedges; modifies the graph
+			G.AutoGroup() // run autogroup; modifies the graph
+			// TODO: do we want to do a transitive reduction?
+
+			graphLog.Debugf("Graph: %v", G) // show graph
+			err := G.ExecGraphviz(obj.GraphvizFilter, obj.Graphviz)
+			if err != nil {
+				mainLog.Errorf("Graphviz: %v", err)
+			} else {
+				mainLog.Info("Graphviz: Successfully generated graph!")
+			}
+			G.AssociateData(converger)
+			// G.Start(...) needs to be synchronous or wait,
+			// because if half of the nodes are started and
+			// some are not ready yet and the EtcdWatch
+			// loops, we'll cause G.Pause(...) before we
+			// even got going, thus causing nil pointer errors
+			G.Start(ctx, &wg, first) // sync
+			converger.Start()        // after G.Start()
+			first = false
+		}
+	}()
+
+	configWatcher := NewConfigWatcher()
+	events := configWatcher.Events()
+	if !obj.NoWatch {
+		configWatcher.Add(obj.Remote...) // add all the files...
+	} else {
+		events = nil // signal that no-watch is true
+	}
+
+	// build remotes struct for remote ssh
+	remotes := NewRemotes(
+		ctx,
+		EmbdEtcd.LocalhostClientURLs().StringSlice(),
+		[]string{DefaultClientURL},
+		obj.Noop,
+		obj.Remote, // list of files
+		events,     // watch for file changes
+		obj.CConns,
+		obj.AllowInteractive,
+		obj.SSHPrivIDRSA,
+		!obj.NoCaching,
+		prefix,
+	)
+
+	// TODO: is there any benefit to running the remotes above in the loop?
+	// wait for etcd to be running before we remote in, which we do above!
+	go remotes.Run()
+
+	if obj.File == "" && obj.Puppet == "" {
+		converger.Start() // better start this for empty graphs
+	}
+	mainLog.Info("Main: Running...")
+
+	<-ctx.Done() // blocks until Exit, a signal, or an internal trigger cancels us
+
+	mainLog.Info("Destroy...")
+
+	configWatcher.Close() // stop sending file changes to remotes
+	remotes.Exit()        // tell all the remote connections to shutdown; waits!
+
+	G.Exit(ctx) // tell all the children to exit
+
+	innerWG.Wait() // let inner main loop finish cleanly before tearing down etcd
+
+	// cleanup etcd main loop last so it can process everything first
+	if err := EmbdEtcd.Destroy(); err != nil { // shutdown and cleanup etcd
+		etcdLog.Errorf("Etcd exited poorly with: %v", err)
+	}
+
+	wg.Wait() // wait for primary go routines to exit
+
+	// TODO: wait for each vertex to exit...
+	mainLog.Info("Goodbye!")
+	obj.exitMu.Lock()
+	defer obj.exitMu.Unlock()
+	return obj.exitErr
+}
@@ -0,0 +1,198 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package snapshot saves and restores enough state to bring a fresh mgmt
+// node up without its original config file or puppet source: an etcd v3
+// snapshot of the embedded cluster, and the shape of the live graph that was
+// running on top of it. This is the same disaster-recovery workflow etcd
+// itself supports for seeding a single member from a snapshot after a
+// quorum loss.
+package snapshot
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/snapshot"
+	"github.com/coreos/pkg/capnslog"
+
+	"github.com/joejulian/mgmt/pkg/etcd"
+)
+
+var log = capnslog.NewPackageLogger("github.com/joejulian/mgmt", "snapshot")
+
+const (
+	etcdEntryName  = "etcd.db"
+	graphEntryName = "graph.json"
+)
+
+// VertexState is the serialized form of one resource vertex in the graph.
+type VertexState struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Hash      string `json:"hash"`      // hash of the resource's state, for drift detection
+	AutoEdge  bool   `json:"autoedge"`  // was this vertex's edges added by autoedge?
+	AutoGroup bool   `json:"autogroup"` // was this vertex merged in by autogroup?
+}
+
+// EdgeState is the serialized form of one edge in the graph.
+type EdgeState struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// GraphState is the serialized form of the active graph (after autoedge and
+// autogroup have run on it): enough to reconstruct
+// the vertex list, edges, and the autoedge/autogroup decisions that were
+// made, without needing to re-run the original config file or puppet
+// source through the compiler.
+type GraphState struct {
+	Vertices []VertexState `json:"vertices"`
+	Edges    []EdgeState   `json:"edges"`
+}
+
+// GraphExporter is implemented by the live graph type so that Save doesn't
+// need to import it directly (which would create an import cycle with the
+// package that embeds Main). The graph package should implement this.
+type GraphExporter interface {
+	ExportSnapshot() (*GraphState, error)
+}
+
+// Save captures an etcd v3 snapshot of the embedded cluster plus the
+// current shape of g, and writes both out to w as a small tar archive.
+func Save(ctx context.Context, e *etcd.EmbdEtcd, g GraphExporter, w io.Writer) error {
+	graphState, err := g.ExportSnapshot()
+	if err != nil {
+		return fmt.Errorf("snapshot: can't export graph: %v", err)
+	}
+	graphBytes, err := json.Marshal(graphState)
+	if err != nil {
+		return fmt.Errorf("snapshot: can't marshal graph: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile("", "mgmt-snapshot-")
+	if err != nil {
+		return fmt.Errorf("snapshot: can't create temp file: %v", err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	endpoints := e.LocalhostClientURLs().StringSlice()
+	if len(endpoints) == 0 {
+		return fmt.Errorf("snapshot: no client URLs to snapshot from")
+	}
+	manager := snapshot.NewV3(nil)
+	if err := manager.Save(ctx, clientv3ConfigFor(endpoints), tmpPath); err != nil {
+		return fmt.Errorf("snapshot: etcd save failed: %v", err)
+	}
+	etcdBytes, err := ioutil.ReadFile(tmpPath)
+	if err != nil {
+		return fmt.Errorf("snapshot: can't read etcd snapshot: %v", err)
+	}
+
+	tw := tar.NewWriter(w)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{etcdEntryName, etcdBytes},
+		{graphEntryName, graphBytes},
+	} {
+		hdr := &tar.Header{Name: entry.name, Size: int64(len(entry.data)), Mode: 0640}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("snapshot: can't write %s header: %v", entry.name, err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			return fmt.Errorf("snapshot: can't write %s: %v", entry.name, err)
+		}
+	}
+	log.Infof("saved snapshot (%d vertices, %d edges, %d bytes of etcd state)", len(graphState.Vertices), len(graphState.Edges), len(etcdBytes))
+	return tw.Close()
+}
+
+// Restore reads a snapshot produced by Save, writes the etcd v3 member data
+// into prefix (so a fresh embedded etcd started against prefix comes up
+// with that data), and returns the graph state that was running at save
+// time so the caller can rebuild its graph from it. etcd refuses to restore
+// into a data directory that already exists, so prefix must not exist yet.
+func Restore(ctx context.Context, r io.Reader, prefix string) (*GraphState, error) {
+	var etcdBytes, graphBytes []byte
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("snapshot: can't read archive: %v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot: can't read %s: %v", hdr.Name, err)
+		}
+		switch hdr.Name {
+		case etcdEntryName:
+			etcdBytes = data
+		case graphEntryName:
+			graphBytes = data
+		}
+	}
+	if etcdBytes == nil || graphBytes == nil {
+		return nil, fmt.Errorf("snapshot: archive is missing %s or %s", etcdEntryName, graphEntryName)
+	}
+
+	tmp, err := ioutil.TempFile("", "mgmt-restore-")
+	if err != nil {
+		return nil, fmt.Errorf("snapshot: can't create temp file: %v", err)
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(etcdBytes); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("snapshot: can't write temp etcd snapshot: %v", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	manager := snapshot.NewV3(nil)
+	if err := manager.Restore(snapshot.RestoreConfig{
+		SnapshotPath:   tmpPath,
+		Name:           "restored",
+		OutputDataDir:  prefix, // etcd writes member/snap and member/wal under this
+		InitialCluster: "restored=http://localhost:2380",
+		PeerURLs:       []string{"http://localhost:2380"},
+	}); err != nil {
+		return nil, fmt.Errorf("snapshot: etcd restore failed: %v", err)
+	}
+
+	var graphState GraphState
+	if err := json.Unmarshal(graphBytes, &graphState); err != nil {
+		return nil, fmt.Errorf("snapshot: can't unmarshal graph: %v", err)
+	}
+	log.Infof("restored snapshot (%d vertices, %d edges) into %s", len(graphState.Vertices), len(graphState.Edges), prefix)
+	return &graphState, nil
+}
+
+func clientv3ConfigFor(endpoints []string) clientv3.Config {
+	return clientv3.Config{Endpoints: endpoints}
+}